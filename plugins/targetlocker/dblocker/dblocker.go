@@ -0,0 +1,437 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package dblocker implements a target.Locker backed by a SQL database,
+// so that target locks are visible to every ConTest instance pointed at
+// the same database.
+package dblocker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	"github.com/facebookincubator/contest/pkg/target"
+	"github.com/facebookincubator/contest/pkg/types"
+	"github.com/facebookincubator/contest/pkg/xcontext"
+)
+
+const (
+	defaultMaxBatchSize = 1000
+
+	// expirySweepInterval is how often the background sweeper looks for
+	// locks that have expired, so that LockWait callers parked on them are
+	// woken up even when nobody calls Unlock.
+	expirySweepInterval = 1 * time.Second
+)
+
+// Option configures a DBLocker at construction time.
+type Option func(*DBLocker)
+
+// WithClock overrides the clock used to compute and evaluate lock
+// expiries. Tests use this to inject a mock clock.
+func WithClock(c clock.Clock) Option {
+	return func(l *DBLocker) { l.clock = c }
+}
+
+// WithMaxBatchSize caps how many targets a single Lock/TryLock/RefreshLocks
+// call will operate on in one SQL statement.
+func WithMaxBatchSize(n int) Option {
+	return func(l *DBLocker) { l.maxBatchSize = n }
+}
+
+// DBLocker is a target.Locker backed by a SQL database.
+type DBLocker struct {
+	db           *sql.DB
+	clock        clock.Clock
+	maxBatchSize int
+	dialect      Dialect
+	namespace    string
+
+	// waiters lets LockWait park on a contended target until it is
+	// released, instead of busy-polling the database.
+	waiters *waiterBroker
+	// events fans out LockEvents to Subscribe callers.
+	events *eventBroker
+}
+
+// New creates a DBLocker connected to the database identified by dsn. The
+// dialect is guessed from the DSN's scheme unless overridden with
+// WithDialect. Without WithNamespace, it shares the database's single flat
+// lock space.
+func New(dsn string, opts ...Option) (*DBLocker, error) {
+	l := &DBLocker{
+		clock:        clock.New(),
+		maxBatchSize: defaultMaxBatchSize,
+		dialect:      dialectFromDSN(dsn),
+		namespace:    defaultNamespace,
+		waiters:      newWaiterBroker(),
+		events:       newEventBroker(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	db, err := sql.Open(l.dialect.driverName(), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("dblocker: failed to open database: %w", err)
+	}
+	l.db = db
+	if err := l.ensureSchema(); err != nil {
+		return nil, err
+	}
+	l.startExpirySweeper()
+	return l, nil
+}
+
+func (l *DBLocker) ensureSchema() error {
+	_, err := l.db.Exec(`
+CREATE TABLE IF NOT EXISTS locks (
+	namespace  VARCHAR(256) NOT NULL DEFAULT '',
+	target_id  VARCHAR(256) NOT NULL,
+	job_id     BIGINT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (namespace, target_id)
+)`)
+	if err != nil {
+		return fmt.Errorf("dblocker: failed to ensure schema: %w", err)
+	}
+	return nil
+}
+
+func targetIDs(targets []*target.Target) []string {
+	ids := make([]string, 0, len(targets))
+	for _, tg := range targets {
+		ids = append(ids, tg.ID)
+	}
+	return ids
+}
+
+// Lock attempts to acquire all of targets for jobID, each held until
+// timeout elapses. It is all-or-nothing: if any target is already held by
+// a different job, none of the requested targets are locked.
+func (l *DBLocker) Lock(ctx xcontext.Context, jobID types.JobID, timeout time.Duration, targets []*target.Target) error {
+	if jobID == 0 {
+		return fmt.Errorf("dblocker: invalid job ID")
+	}
+	for _, tg := range targets {
+		if tg.ID == "" {
+			return fmt.Errorf("dblocker: target with empty ID")
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	expiresAt := l.clock.Now().Add(timeout)
+	if err := l.lockAll(ctx, jobID, expiresAt, targets); err != nil {
+		return err
+	}
+	l.events.publish(LockEvent{Kind: LockEventLocked, JobID: jobID, TargetIDs: targetIDs(targets), At: l.clock.Now()})
+	return nil
+}
+
+// lockAll is all-or-nothing: it reads every target's current owner off the
+// same SELECT ... FOR UPDATE it needs anyway, and if any of them are
+// contended it returns a LockConflictError describing all of them (not
+// just the first) instead of writing any lock. maxBatchSize only bounds
+// how many targets share a round trip; every chunk runs in the one
+// transaction this started, so a conflict discovered in a later chunk
+// still rolls back chunks already read or written in this call.
+func (l *DBLocker) lockAll(ctx xcontext.Context, jobID types.JobID, expiresAt time.Time, targets []*target.Target) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return fmt.Errorf("dblocker: failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	selectSQL := l.dialect.selectLockForUpdateSQL(false)
+	var conflicts []ConflictedTarget
+	for _, batch := range batches(targets, l.maxBatchSize) {
+		for _, tg := range batch {
+			var ownerJobID types.JobID
+			var rowExpiresAt time.Time
+			row := tx.QueryRow(selectSQL, l.namespace, tg.ID)
+			switch err := row.Scan(&ownerJobID, &rowExpiresAt); err {
+			case sql.ErrNoRows:
+				// free, nothing held on this target
+			case nil:
+				if ownerJobID != jobID && rowExpiresAt.After(l.clock.Now()) {
+					conflicts = append(conflicts, ConflictedTarget{TargetID: tg.ID, OwnerJobID: ownerJobID, ExpiresAt: rowExpiresAt})
+				}
+			default:
+				return fmt.Errorf("dblocker: failed to read lock for %s: %w", tg.ID, err)
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return &LockConflictError{Targets: conflicts}
+	}
+
+	upsertSQL := l.dialect.upsertLockSQL()
+	for _, batch := range batches(targets, l.maxBatchSize) {
+		for _, tg := range batch {
+			if _, err := tx.Exec(upsertSQL, l.namespace, tg.ID, jobID, expiresAt); err != nil {
+				return fmt.Errorf("dblocker: failed to write lock for %s: %w", tg.ID, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Unlock releases targets held by jobID. Targets held by a different job
+// are left untouched and no error is returned.
+func (l *DBLocker) Unlock(ctx xcontext.Context, jobID types.JobID, targets []*target.Target) error {
+	if jobID == 0 {
+		return fmt.Errorf("dblocker: invalid job ID")
+	}
+	deleteSQL := l.dialect.deleteLockSQL()
+	var unlocked []string
+	for _, batch := range batches(targets, l.maxBatchSize) {
+		for _, tg := range batch {
+			res, err := l.db.Exec(deleteSQL, l.namespace, tg.ID, jobID)
+			if err != nil {
+				return fmt.Errorf("dblocker: failed to unlock %s: %w", tg.ID, err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				unlocked = append(unlocked, tg.ID)
+			}
+		}
+	}
+	if len(unlocked) == 0 {
+		return nil
+	}
+	l.waiters.notify(unlocked)
+	l.events.publish(LockEvent{Kind: LockEventUnlocked, JobID: jobID, TargetIDs: unlocked, At: l.clock.Now()})
+	return nil
+}
+
+// TryLock locks up to limit of the requested targets that are currently
+// free (or already held by jobID), and returns the IDs that were locked.
+// Unlike Lock, it never fails because some targets are contended.
+func (l *DBLocker) TryLock(ctx xcontext.Context, jobID types.JobID, timeout time.Duration, targets []*target.Target, limit uint) ([]string, error) {
+	locked := make([]string, 0, limit)
+	expiresAt := l.clock.Now().Add(timeout)
+	for _, tg := range targets {
+		if uint(len(locked)) >= limit {
+			break
+		}
+		ok, err := l.tryLockOne(ctx, jobID, expiresAt, tg)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			locked = append(locked, tg.ID)
+		}
+	}
+	if len(locked) > 0 {
+		l.events.publish(LockEvent{Kind: LockEventLocked, JobID: jobID, TargetIDs: locked, At: l.clock.Now()})
+	}
+	return locked, nil
+}
+
+func (l *DBLocker) tryLockOne(ctx xcontext.Context, jobID types.JobID, expiresAt time.Time, tg *target.Target) (bool, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("dblocker: failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var ownerJobID types.JobID
+	var rowExpiresAt time.Time
+	// SKIP LOCKED (postgres only): a row currently locked by another
+	// in-flight TryLock is treated the same as contended rather than
+	// queueing behind it.
+	row := tx.QueryRow(l.dialect.selectLockForUpdateSQL(true), l.namespace, tg.ID)
+	switch err := row.Scan(&ownerJobID, &rowExpiresAt); err {
+	case sql.ErrNoRows:
+		// Either genuinely free, or (postgres) skipped because another
+		// transaction holds it. A plain insert (not an upsert) tells the
+		// two apart: if another transaction wins the race and commits
+		// first, our insert fails on the unique key instead of silently
+		// overwriting its lock.
+		if _, err := tx.Exec(l.dialect.insertLockSQL(), l.namespace, tg.ID, jobID, expiresAt); err != nil {
+			if l.dialect.isUniqueViolation(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("dblocker: failed to write lock for %s: %w", tg.ID, err)
+		}
+		return true, tx.Commit()
+	case nil:
+		if ownerJobID != jobID && rowExpiresAt.After(l.clock.Now()) {
+			return false, nil
+		}
+	default:
+		return false, fmt.Errorf("dblocker: failed to read lock for %s: %w", tg.ID, err)
+	}
+	if _, err := tx.Exec(l.dialect.updateLockSQL(), jobID, expiresAt, l.namespace, tg.ID); err != nil {
+		return false, fmt.Errorf("dblocker: failed to write lock for %s: %w", tg.ID, err)
+	}
+	return true, tx.Commit()
+}
+
+// refreshExtension is how far RefreshLocks pushes out a lock's expiry.
+// It mirrors the timeout callers typically pass to Lock/TryLock; jobs that
+// need a different cadence should call Lock again instead.
+const refreshExtension = 2 * time.Second
+
+// RefreshLocks extends the expiry of targets already held by jobID.
+func (l *DBLocker) RefreshLocks(ctx xcontext.Context, jobID types.JobID, targets []*target.Target) error {
+	expiresAt := l.clock.Now().Add(refreshExtension)
+	refreshSQL := l.dialect.updateExpirySQL()
+	var refreshed []string
+	for _, batch := range batches(targets, l.maxBatchSize) {
+		for _, tg := range batch {
+			res, err := l.db.Exec(refreshSQL, expiresAt, l.namespace, tg.ID, jobID)
+			if err != nil {
+				return fmt.Errorf("dblocker: failed to refresh lock for %s: %w", tg.ID, err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				refreshed = append(refreshed, tg.ID)
+			}
+		}
+	}
+	if len(refreshed) == 0 {
+		return nil
+	}
+	l.events.publish(LockEvent{Kind: LockEventRefreshed, JobID: jobID, TargetIDs: refreshed, At: l.clock.Now()})
+	return nil
+}
+
+// ResetAllLocks clears every lock in the DBLocker's namespace
+// unconditionally. It exists for tests.
+func (l *DBLocker) ResetAllLocks(ctx xcontext.Context) error {
+	if _, err := l.db.Exec(l.dialect.deleteNamespaceSQL(), l.namespace); err != nil {
+		return fmt.Errorf("dblocker: failed to reset locks: %w", err)
+	}
+	l.waiters.notifyAll()
+	return nil
+}
+
+// Subscribe returns a channel of LockEvents describing the Locked,
+// Unlocked, Refreshed and Expired state changes made from this point on
+// by this DBLocker's own calls and its own expiry sweeper, so schedulers
+// and dashboards can react to target availability without polling the
+// database. Changes made through other DBLocker instances are not seen,
+// ResetAllLocks publishes no event, and events are dropped for a
+// subscriber whose buffer is full. The channel is closed once ctx is done.
+func (l *DBLocker) Subscribe(ctx xcontext.Context) <-chan LockEvent {
+	return l.events.subscribe(ctx)
+}
+
+// LockWait blocks until all of targets are acquirable by jobID, or until
+// ctx is cancelled or deadline elapses, without polling: on conflict it
+// parks on the in-process waiter broker until a relevant target is freed
+// by Unlock, ResetAllLocks or the expiry sweeper, then retries the
+// transactional Lock.
+func (l *DBLocker) LockWait(ctx xcontext.Context, jobID types.JobID, timeout time.Duration, targets []*target.Target, deadline time.Duration) error {
+	ids := targetIDs(targets)
+	deadlineCh := l.clock.After(deadline)
+	for {
+		released, cancel := l.waiters.register(ids)
+		err := l.Lock(ctx, jobID, timeout, targets)
+		if err == nil {
+			cancel()
+			return nil
+		}
+		var conflictErr *LockConflictError
+		if !errors.As(err, &conflictErr) {
+			cancel()
+			return err
+		}
+		select {
+		case <-released:
+			cancel()
+		case <-ctx.Done():
+			cancel()
+			return fmt.Errorf("dblocker: LockWait for %v cancelled: %w", ids, ctx.Err())
+		case <-deadlineCh:
+			cancel()
+			return fmt.Errorf("dblocker: LockWait for %v timed out after %s", ids, deadline)
+		}
+	}
+}
+
+// startExpirySweeper runs a background goroutine that periodically clears
+// expired locks, so LockWait callers parked on a lock that nobody ever
+// explicitly unlocks still get woken up once it lapses.
+func (l *DBLocker) startExpirySweeper() {
+	ticker := l.clock.Ticker(expirySweepInterval)
+	go func() {
+		for range ticker.C {
+			l.sweepExpired()
+		}
+	}()
+}
+
+func (l *DBLocker) sweepExpired() {
+	now := l.clock.Now()
+	rows, err := l.db.Query(l.dialect.selectExpiredSQL(), l.namespace, now)
+	if err != nil {
+		return
+	}
+	type candidate struct {
+		targetID string
+		jobID    types.JobID
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var id string
+		var jobID types.JobID
+		if err := rows.Scan(&id, &jobID); err == nil {
+			candidates = append(candidates, candidate{targetID: id, jobID: jobID})
+		}
+	}
+	rows.Close()
+
+	// Re-check job_id and expires_at on delete: a lock refreshed or
+	// re-acquired between the SELECT above and here must not be reported
+	// as expired just because it looked lapsed a moment ago.
+	expiredByJob := make(map[types.JobID][]string)
+	for _, c := range candidates {
+		res, err := l.db.Exec(l.dialect.deleteExpiredOneSQL(), l.namespace, c.targetID, c.jobID, now)
+		if err != nil {
+			continue
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		expiredByJob[c.jobID] = append(expiredByJob[c.jobID], c.targetID)
+	}
+	if len(expiredByJob) == 0 {
+		return
+	}
+
+	var allExpired []string
+	for jobID, ids := range expiredByJob {
+		allExpired = append(allExpired, ids...)
+		l.events.publish(LockEvent{Kind: LockEventExpired, JobID: jobID, TargetIDs: ids, At: now})
+	}
+	l.waiters.notify(allExpired)
+}
+
+// batches splits targets into chunks of at most size, so a single round
+// trip never covers more than maxBatchSize targets. size <= 0 returns
+// targets as a single chunk. Callers that need every chunk to commit or
+// roll back together must wrap the whole loop in one transaction
+// themselves; batches only bounds chunk size, it doesn't start one.
+func batches(targets []*target.Target, size int) [][]*target.Target {
+	if size <= 0 {
+		return [][]*target.Target{targets}
+	}
+	var out [][]*target.Target
+	for i := 0; i < len(targets); i += size {
+		end := i + size
+		if end > len(targets) {
+			end = len(targets)
+		}
+		out = append(out, targets[i:end])
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package dblocker
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// Dialect selects the SQL driver and query templates DBLocker uses to talk
+// to the backing database.
+type Dialect string
+
+const (
+	// DialectMySQL is the original, default backend.
+	DialectMySQL Dialect = "mysql"
+	// DialectPostgres uses SELECT ... FOR UPDATE SKIP LOCKED in TryLock, so
+	// batched partial acquires scale without queueing behind each other's
+	// row locks when many jobs contend for overlapping target pools.
+	DialectPostgres Dialect = "postgres"
+)
+
+// WithDialect overrides dialect detection and forces DBLocker to use the
+// given backend's driver and SQL templates.
+func WithDialect(d Dialect) Option {
+	return func(l *DBLocker) { l.dialect = d }
+}
+
+// dialectFromDSN guesses the dialect from the DSN's scheme, e.g.
+// "postgres://..." or "postgresql://...". DSNs without a recognized scheme,
+// such as a bare go-sql-driver/mysql "user:pass@tcp(host)/db", default to
+// mysql to preserve existing behavior.
+func dialectFromDSN(dsn string) Dialect {
+	if u, err := url.Parse(dsn); err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "postgres", "postgresql":
+			return DialectPostgres
+		}
+	}
+	return DialectMySQL
+}
+
+func (d Dialect) driverName() string {
+	if d == DialectPostgres {
+		return "postgres"
+	}
+	return "mysql"
+}
+
+// ph returns the i-th (1-based) bind parameter placeholder for the
+// dialect, e.g. "?" for mysql and "$1" for postgres.
+func (d Dialect) ph(i int) string {
+	if d == DialectPostgres {
+		return "$" + strconv.Itoa(i)
+	}
+	return "?"
+}
+
+// upsertLockSQL returns the statement that inserts a new lock row or, if
+// one already exists for the same key, overwrites its owner and expiry.
+// Bind order: namespace, target_id, job_id, expires_at.
+func (d Dialect) upsertLockSQL() string {
+	if d == DialectPostgres {
+		return `
+INSERT INTO locks (namespace, target_id, job_id, expires_at) VALUES (` + d.ph(1) + `, ` + d.ph(2) + `, ` + d.ph(3) + `, ` + d.ph(4) + `)
+ON CONFLICT (namespace, target_id) DO UPDATE SET job_id = EXCLUDED.job_id, expires_at = EXCLUDED.expires_at`
+	}
+	return `
+REPLACE INTO locks (namespace, target_id, job_id, expires_at) VALUES (?, ?, ?, ?)`
+}
+
+// insertLockSQL returns a plain insert (no upsert) used for the free-target
+// path of TryLock. Leaving it as a plain insert means a target that two
+// transactions both believe is free surfaces as a unique-constraint error
+// to whichever one loses the race, instead of one silently overwriting the
+// other's lock. Bind order: namespace, target_id, job_id, expires_at.
+func (d Dialect) insertLockSQL() string {
+	return "INSERT INTO locks (namespace, target_id, job_id, expires_at) VALUES (" +
+		d.ph(1) + ", " + d.ph(2) + ", " + d.ph(3) + ", " + d.ph(4) + ")"
+}
+
+// updateLockSQL returns the statement used to re-lock (or extend) a target
+// TryLock already confirmed is owned by jobID, or to take over a target
+// whose lock has expired. Bind order: job_id, expires_at, namespace,
+// target_id.
+func (d Dialect) updateLockSQL() string {
+	return "UPDATE locks SET job_id = " + d.ph(1) + ", expires_at = " + d.ph(2) +
+		" WHERE namespace = " + d.ph(3) + " AND target_id = " + d.ph(4)
+}
+
+// isUniqueViolation reports whether err is a primary/unique key conflict,
+// i.e. someone else's transaction won the race to insert this target's row
+// first.
+func (d Dialect) isUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		const erDupEntry = 1062
+		return mysqlErr.Number == erDupEntry
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		const uniqueViolation = "23505"
+		return pqErr.Code == uniqueViolation
+	}
+	return false
+}
+
+// selectLockForUpdateSQL returns the query used to read a lock row's owner
+// while holding a row lock on it. skipLocked requests SKIP LOCKED, which
+// TryLock uses so a batch of concurrent callers over an overlapping target
+// pool don't queue up behind each other's in-flight transactions; Lock
+// cannot use it, since it needs to know who holds a contended row rather
+// than skip past it. Bind order: namespace, target_id.
+func (d Dialect) selectLockForUpdateSQL(skipLocked bool) string {
+	q := "SELECT job_id, expires_at FROM locks WHERE namespace = " + d.ph(1) + " AND target_id = " + d.ph(2) + " FOR UPDATE"
+	if skipLocked && d == DialectPostgres {
+		q += " SKIP LOCKED"
+	}
+	return q
+}
+
+// deleteLockSQL returns the statement Unlock uses. Bind order: namespace,
+// target_id, job_id.
+func (d Dialect) deleteLockSQL() string {
+	return "DELETE FROM locks WHERE namespace = " + d.ph(1) + " AND target_id = " + d.ph(2) + " AND job_id = " + d.ph(3)
+}
+
+// updateExpirySQL returns the statement RefreshLocks uses. Bind order:
+// expires_at, namespace, target_id, job_id.
+func (d Dialect) updateExpirySQL() string {
+	return "UPDATE locks SET expires_at = " + d.ph(1) +
+		" WHERE namespace = " + d.ph(2) + " AND target_id = " + d.ph(3) + " AND job_id = " + d.ph(4)
+}
+
+// selectExpiredSQL returns the query the expiry sweeper uses to find
+// lapsed locks within its configured namespace, along with the job that
+// held each one so Expired events can be grouped and emitted per job.
+// Bind order: namespace, expires_at.
+func (d Dialect) selectExpiredSQL() string {
+	return "SELECT target_id, job_id FROM locks WHERE namespace = " + d.ph(1) + " AND expires_at <= " + d.ph(2)
+}
+
+// deleteExpiredOneSQL returns the statement the expiry sweeper uses to
+// clear a single lock it found expired, re-checking job_id and expires_at
+// so a lock concurrently refreshed or re-acquired between the sweeper's
+// SELECT and this DELETE is left alone instead of being removed (and its
+// Expired event published) out from under its new owner. Bind order:
+// namespace, target_id, job_id, expires_at.
+func (d Dialect) deleteExpiredOneSQL() string {
+	return "DELETE FROM locks WHERE namespace = " + d.ph(1) + " AND target_id = " + d.ph(2) +
+		" AND job_id = " + d.ph(3) + " AND expires_at <= " + d.ph(4)
+}
+
+// deleteNamespaceSQL returns the statement ResetAllLocks uses to clear
+// every lock in its own namespace, leaving other namespaces untouched.
+// Bind order: namespace.
+func (d Dialect) deleteNamespaceSQL() string {
+	return "DELETE FROM locks WHERE namespace = " + d.ph(1)
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package dblocker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/facebookincubator/contest/pkg/types"
+)
+
+// ConflictedTarget describes one target that could not be locked because
+// it is already held by another job.
+type ConflictedTarget struct {
+	TargetID   string
+	OwnerJobID types.JobID
+	ExpiresAt  time.Time
+}
+
+// LockConflictError is returned by Lock when one or more requested
+// targets are held by a different job; TryLock never returns it, since
+// it stays best-effort on contention by design. It carries the same
+// ownership and expiry information the SQL path already read off its
+// SELECT ... FOR UPDATE, so callers can decide how long to back off
+// without an extra round trip.
+type LockConflictError struct {
+	Targets []ConflictedTarget
+}
+
+func (e *LockConflictError) Error() string {
+	parts := make([]string, 0, len(e.Targets))
+	for _, ct := range e.Targets {
+		parts = append(parts, fmt.Sprintf("%s held by job %d until %s", ct.TargetID, ct.OwnerJobID, ct.ExpiresAt))
+	}
+	return fmt.Sprintf("dblocker: lock conflict: %s", strings.Join(parts, ", "))
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package dblocker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/facebookincubator/contest/pkg/types"
+	"github.com/facebookincubator/contest/pkg/xcontext"
+)
+
+// LockEventKind identifies what happened to a set of targets in a
+// LockEvent.
+type LockEventKind int
+
+const (
+	// LockEventLocked means Lock or TryLock successfully acquired the
+	// targets.
+	LockEventLocked LockEventKind = iota
+	// LockEventUnlocked means Unlock released the targets.
+	LockEventUnlocked
+	// LockEventRefreshed means RefreshLocks extended the targets' expiry.
+	LockEventRefreshed
+	// LockEventExpired means the expiry sweeper found the targets' lock
+	// lapsed and cleared it.
+	LockEventExpired
+)
+
+// LockEvent describes one state change to a set of targets, as seen by
+// Subscribe.
+type LockEvent struct {
+	Kind      LockEventKind
+	JobID     types.JobID
+	TargetIDs []string
+	At        time.Time
+}
+
+// eventSubscriberBuffer bounds how far a Subscribe channel can lag before
+// further events for it are dropped, so a slow or abandoned subscriber
+// never blocks Lock/Unlock/RefreshLocks or the expiry sweeper.
+const eventSubscriberBuffer = 64
+
+// eventBroker fans LockEvents out to every active Subscribe caller.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan LockEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: make(map[chan LockEvent]struct{})}
+}
+
+// subscribe registers a new LockEvent channel that stays open until ctx is
+// done, at which point it is unregistered and closed.
+func (b *eventBroker) subscribe(ctx xcontext.Context) <-chan LockEvent {
+	ch := make(chan LockEvent, eventSubscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// publish fans ev out to every subscriber. A subscriber that isn't
+// draining its channel fast enough has the event dropped rather than
+// stalling the caller that triggered it.
+func (b *eventBroker) publish(ev LockEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package dblocker
+
+// defaultNamespace is used by DBLocker instances that don't set
+// WithNamespace, so existing call sites keep their original behavior of
+// sharing one flat lock space.
+const defaultNamespace = ""
+
+// WithNamespace scopes a DBLocker to namespace: target IDs are only unique
+// within a namespace, so the same target ID string can be locked
+// independently by different ConTest deployments sharing a database.
+// ResetAllLocks and the expiry sweeper are likewise scoped to namespace,
+// so one deployment can never see or clear another's locks.
+func WithNamespace(namespace string) Option {
+	return func(l *DBLocker) { l.namespace = namespace }
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package dblocker
+
+import "sync"
+
+// waiterBroker lets LockWait park on a set of target IDs until one of them
+// is released, instead of busy-polling the database. It is purely
+// in-process: every DBLocker keeps its own broker, fed by its own
+// Unlock/ResetAllLocks calls and its own expiry sweeper.
+type waiterBroker struct {
+	mu      sync.Mutex
+	waiting map[string][]chan struct{}
+	// fired tracks channels that have already been closed, so a waiter
+	// registered under more than one target ID (every multi-target
+	// LockWait) isn't closed a second time when its other targets are
+	// notified separately, e.g. by two later Unlock calls.
+	fired map[chan struct{}]bool
+}
+
+func newWaiterBroker() *waiterBroker {
+	return &waiterBroker{
+		waiting: make(map[string][]chan struct{}),
+		fired:   make(map[chan struct{}]bool),
+	}
+}
+
+// register returns a channel that fires the next time any of targetIDs is
+// released, and a cancel func. cancel must be called exactly once the
+// caller is done waiting, whether or not the channel fired, so the
+// registration doesn't leak.
+func (b *waiterBroker) register(targetIDs []string) (ch <-chan struct{}, cancel func()) {
+	c := make(chan struct{})
+	b.mu.Lock()
+	for _, id := range targetIDs {
+		b.waiting[id] = append(b.waiting[id], c)
+	}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, id := range targetIDs {
+				b.waiting[id] = removeWaiterChan(b.waiting[id], c)
+				if len(b.waiting[id]) == 0 {
+					delete(b.waiting, id)
+				}
+			}
+			delete(b.fired, c)
+		})
+	}
+}
+
+// notify wakes every waiter registered on any of targetIDs. Each waiter
+// channel fires at most once, even across separate notify calls for its
+// other target IDs; waiters that want to keep watching must register
+// again.
+func (b *waiterBroker) notify(targetIDs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, id := range targetIDs {
+		for _, c := range b.waiting[id] {
+			if !b.fired[c] {
+				b.fired[c] = true
+				close(c)
+			}
+		}
+		delete(b.waiting, id)
+	}
+}
+
+// notifyAll wakes every registered waiter, regardless of target ID. Used by
+// ResetAllLocks, which releases everything at once.
+func (b *waiterBroker) notifyAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, chans := range b.waiting {
+		for _, c := range chans {
+			if !b.fired[c] {
+				b.fired[c] = true
+				close(c)
+			}
+		}
+		delete(b.waiting, id)
+	}
+}
+
+func removeWaiterChan(chans []chan struct{}, target chan struct{}) []chan struct{} {
+	out := chans[:0]
+	for _, c := range chans {
+		if c != target {
+			out = append(out, c)
+		}
+	}
+	return out
+}
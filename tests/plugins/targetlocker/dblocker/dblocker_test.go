@@ -8,15 +8,18 @@
 package dblocker
 
 import (
+	"errors"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/facebookincubator/contest/pkg/target"
 	"github.com/facebookincubator/contest/pkg/types"
+	"github.com/facebookincubator/contest/pkg/xcontext"
 	"github.com/facebookincubator/contest/pkg/xcontext/bundles/logrusctx"
 	"github.com/facebookincubator/contest/pkg/xcontext/logger"
 	"github.com/facebookincubator/contest/plugins/targetlocker/dblocker"
@@ -43,75 +46,137 @@ var (
 	tl *dblocker.DBLocker
 
 	tlClock = clock.NewMock()
+
+	// dialectLockers holds one DBLocker per dialect under test, so that
+	// every scenario below runs against both the mysql and the
+	// postgres backend.
+	dialectLockers map[string]*dblocker.DBLocker
 )
 
 func TestMain(m *testing.M) {
 	// tests reset the database, which makes the locker yell all the time,
 	// disable for the integration tests
 
-	var err error
-	tl, err = dblocker.New(
-		common.GetDatabaseURI(),
-		dblocker.WithClock(tlClock),
-		dblocker.WithMaxBatchSize(testBatchSize),
-	)
-	if err != nil {
-		panic(err)
+	dialectLockers = make(map[string]*dblocker.DBLocker, len(common.GetDatabaseURI()))
+	for dialect, uri := range common.GetDatabaseURI() {
+		l, err := dblocker.New(
+			uri,
+			dblocker.WithDialect(dblocker.Dialect(dialect)),
+			dblocker.WithClock(tlClock),
+			dblocker.WithMaxBatchSize(testBatchSize),
+		)
+		if err != nil {
+			panic(err)
+		}
+		dialectLockers[dialect] = l
 	}
-	// mysql doesn't like epoch, so jump forward a bit
+	// the mysql backend doesn't like epoch, so jump forward a bit; this is
+	// harmless for the other dialects since they share the same mock clock
 	tlClock.Add(1 * time.Hour)
+
+	// tl keeps pointing at the mysql locker; all tests below go through
+	// forEachDialect instead and get their locker as a parameter
+	tl = dialectLockers["mysql"]
+
 	os.Exit(m.Run())
 }
 
-func TestNew(t *testing.T) {
+// forEachDialect runs f once per configured dialect, as a subtest named
+// after the dialect, each against its own DBLocker instance.
+func forEachDialect(t *testing.T, f func(t *testing.T, tl *dblocker.DBLocker)) {
+	for dialect, tl := range dialectLockers {
+		dialect, tl := dialect, tl
+		t.Run(dialect, func(t *testing.T) {
+			f(t, tl)
+		})
+	}
+}
+
+func testNew(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NotNil(t, tl)
 	assert.IsType(t, &dblocker.DBLocker{}, tl)
 }
 
-func TestLockInvalidJobIDAndNoTargets(t *testing.T) {
+func TestNew(t *testing.T) {
+	forEachDialect(t, testNew)
+}
+
+func testLockInvalidJobIDAndNoTargets(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.Error(t, tl.Lock(ctx, 0, defaultJobTargetManagerAcquireTimeout, nil))
 }
 
-func TestLockValidJobIDAndNoTargets(t *testing.T) {
+func TestLockInvalidJobIDAndNoTargets(t *testing.T) {
+	forEachDialect(t, testLockInvalidJobIDAndNoTargets)
+}
+
+func testLockValidJobIDAndNoTargets(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, nil))
 }
 
-func TestLockValidJobIDAndNoTargets2(t *testing.T) {
+func TestLockValidJobIDAndNoTargets(t *testing.T) {
+	forEachDialect(t, testLockValidJobIDAndNoTargets)
+}
+
+func testLockValidJobIDAndNoTargets2(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, []*target.Target{}))
 }
 
-func TestLockInvalidJobIDAndOneTarget(t *testing.T) {
+func TestLockValidJobIDAndNoTargets2(t *testing.T) {
+	forEachDialect(t, testLockValidJobIDAndNoTargets2)
+}
+
+func testLockInvalidJobIDAndOneTarget(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.Error(t, tl.Lock(ctx, 0, defaultJobTargetManagerAcquireTimeout, oneTarget))
 }
 
-func TestLockValidJobIDAndEmptyIDTarget(t *testing.T) {
+func TestLockInvalidJobIDAndOneTarget(t *testing.T) {
+	forEachDialect(t, testLockInvalidJobIDAndOneTarget)
+}
+
+func testLockValidJobIDAndEmptyIDTarget(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.Error(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, []*target.Target{&target.Target{ID: ""}}))
 }
 
-func TestLockValidJobIDAndOneTarget(t *testing.T) {
+func TestLockValidJobIDAndEmptyIDTarget(t *testing.T) {
+	forEachDialect(t, testLockValidJobIDAndEmptyIDTarget)
+}
+
+func testLockValidJobIDAndOneTarget(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
 }
 
-func TestLockValidJobIDAndTwoTargets(t *testing.T) {
+func TestLockValidJobIDAndOneTarget(t *testing.T) {
+	forEachDialect(t, testLockValidJobIDAndOneTarget)
+}
+
+func testLockValidJobIDAndTwoTargets(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
 }
 
-func TestLockReentrantLock(t *testing.T) {
+func TestLockValidJobIDAndTwoTargets(t *testing.T) {
+	forEachDialect(t, testLockValidJobIDAndTwoTargets)
+}
+
+func testLockReentrantLock(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, allTargets))
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, allTargets))
 }
 
-func TestLockReentrantLockDifferentJobID(t *testing.T) {
+func TestLockReentrantLock(t *testing.T) {
+	forEachDialect(t, testLockReentrantLock)
+}
+
+func testLockReentrantLockDifferentJobID(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, allTargets))
 	assert.Error(t, tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, oneTarget))
@@ -120,38 +185,88 @@ func TestLockReentrantLockDifferentJobID(t *testing.T) {
 	assert.Error(t, tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, []*target.Target{allTargets[3]}))
 }
 
-func TestUnlockInvalidJobIDAndNoTargets(t *testing.T) {
+func TestLockReentrantLockDifferentJobID(t *testing.T) {
+	forEachDialect(t, testLockReentrantLockDifferentJobID)
+}
+
+func testLockReentrantLockDifferentJobIDConflictError(t *testing.T, tl *dblocker.DBLocker) {
+	tl.ResetAllLocks(ctx)
+	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, allTargets))
+
+	err := tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, twoTargets)
+	require.Error(t, err)
+	var conflictErr *dblocker.LockConflictError
+	require.True(t, errors.As(err, &conflictErr))
+	require.Len(t, conflictErr.Targets, 2)
+	for _, ct := range conflictErr.Targets {
+		assert.Contains(t, []string{twoTargets[0].ID, twoTargets[1].ID}, ct.TargetID)
+		assert.Equal(t, jobID, ct.OwnerJobID)
+		// same instant; the time read back from the database may carry a
+		// different location than the mock clock's
+		assert.WithinDuration(t, tlClock.Now().Add(defaultJobTargetManagerAcquireTimeout), ct.ExpiresAt, 0)
+	}
+}
+
+func TestLockReentrantLockDifferentJobIDConflictError(t *testing.T) {
+	forEachDialect(t, testLockReentrantLockDifferentJobIDConflictError)
+}
+
+func testUnlockInvalidJobIDAndNoTargets(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Unlock(ctx, jobID, nil))
 }
 
-func TestUnlockValidJobIDAndNoTargets(t *testing.T) {
+func TestUnlockInvalidJobIDAndNoTargets(t *testing.T) {
+	forEachDialect(t, testUnlockInvalidJobIDAndNoTargets)
+}
+
+func testUnlockValidJobIDAndNoTargets(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Unlock(ctx, jobID, nil))
 }
 
-func TestUnlockInvalidJobIDAndOneTarget(t *testing.T) {
+func TestUnlockValidJobIDAndNoTargets(t *testing.T) {
+	forEachDialect(t, testUnlockValidJobIDAndNoTargets)
+}
+
+func testUnlockInvalidJobIDAndOneTarget(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.Error(t, tl.Unlock(ctx, 0, oneTarget))
 }
 
-func TestUnlockValidJobIDAndOneTarget(t *testing.T) {
+func TestUnlockInvalidJobIDAndOneTarget(t *testing.T) {
+	forEachDialect(t, testUnlockInvalidJobIDAndOneTarget)
+}
+
+func testUnlockValidJobIDAndOneTarget(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Unlock(ctx, jobID, oneTarget))
 }
 
-func TestUnlockValidJobIDAndTwoTargets(t *testing.T) {
+func TestUnlockValidJobIDAndOneTarget(t *testing.T) {
+	forEachDialect(t, testUnlockValidJobIDAndOneTarget)
+}
+
+func testUnlockValidJobIDAndTwoTargets(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Unlock(ctx, jobID, twoTargets))
 }
 
-func TestLockUnlockSameJobID(t *testing.T) {
+func TestUnlockValidJobIDAndTwoTargets(t *testing.T) {
+	forEachDialect(t, testUnlockValidJobIDAndTwoTargets)
+}
+
+func testLockUnlockSameJobID(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, allTargets))
 	assert.NoError(t, tl.Unlock(ctx, jobID, allTargets))
 }
 
-func TestLockUnlockDifferentJobID(t *testing.T) {
+func TestLockUnlockSameJobID(t *testing.T) {
+	forEachDialect(t, testLockUnlockSameJobID)
+}
+
+func testLockUnlockDifferentJobID(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, allTargets))
 	// this does not error, but will also not release the lock...
@@ -160,14 +275,22 @@ func TestLockUnlockDifferentJobID(t *testing.T) {
 	assert.Error(t, tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, twoTargets))
 }
 
-func TestTryLockOne(t *testing.T) {
+func TestLockUnlockDifferentJobID(t *testing.T) {
+	forEachDialect(t, testLockUnlockDifferentJobID)
+}
+
+func testTryLockOne(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	res, err := tl.TryLock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget, 1)
 	assert.NoError(t, err)
 	assert.Equal(t, oneTarget[0].ID, res[0])
 }
 
-func TestTryLockTwo(t *testing.T) {
+func TestTryLockOne(t *testing.T) {
+	forEachDialect(t, testTryLockOne)
+}
+
+func testTryLockTwo(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	res, err := tl.TryLock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets, 2)
 	assert.NoError(t, err)
@@ -176,7 +299,11 @@ func TestTryLockTwo(t *testing.T) {
 	assert.Contains(t, res, twoTargets[1].ID)
 }
 
-func TestTryLockSome(t *testing.T) {
+func TestTryLockTwo(t *testing.T) {
+	forEachDialect(t, testTryLockTwo)
+}
+
+func testTryLockSome(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
 	res, err := tl.TryLock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, allTargets, uint(len(allTargets)))
@@ -187,7 +314,11 @@ func TestTryLockSome(t *testing.T) {
 	assert.Contains(t, res, allTargets[3].ID)
 }
 
-func TestTryLockSameJob(t *testing.T) {
+func TestTryLockSome(t *testing.T) {
+	forEachDialect(t, testTryLockSome)
+}
+
+func testTryLockSameJob(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
 	// job is the same, so we get all 4
@@ -200,7 +331,11 @@ func TestTryLockSameJob(t *testing.T) {
 	assert.Contains(t, res, allTargets[3].ID)
 }
 
-func TestInMemoryTryLockZeroLimited(t *testing.T) {
+func TestTryLockSameJob(t *testing.T) {
+	forEachDialect(t, testTryLockSameJob)
+}
+
+func testInMemoryTryLockZeroLimited(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	// only request one
 	res, err := tl.TryLock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets, 0)
@@ -209,7 +344,11 @@ func TestInMemoryTryLockZeroLimited(t *testing.T) {
 	assert.Equal(t, len(res), 0)
 }
 
-func TestTryLockTwoHigherLimit(t *testing.T) {
+func TestInMemoryTryLockZeroLimited(t *testing.T) {
+	forEachDialect(t, testInMemoryTryLockZeroLimited)
+}
+
+func testTryLockTwoHigherLimit(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	// limit is just an upper bound, can be higher
 	res, err := tl.TryLock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets, 100)
@@ -219,7 +358,11 @@ func TestTryLockTwoHigherLimit(t *testing.T) {
 	assert.Contains(t, res, twoTargets[1].ID)
 }
 
-func TestInMemoryTryLockOneLimited(t *testing.T) {
+func TestTryLockTwoHigherLimit(t *testing.T) {
+	forEachDialect(t, testTryLockTwoHigherLimit)
+}
+
+func testInMemoryTryLockOneLimited(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	// only request one
 	res, err := tl.TryLock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets, 1)
@@ -232,7 +375,11 @@ func TestInMemoryTryLockOneLimited(t *testing.T) {
 	assert.NotContains(t, res, twoTargets[1].ID)
 }
 
-func TestInMemoryTryLockOneOfTwo(t *testing.T) {
+func TestInMemoryTryLockOneLimited(t *testing.T) {
+	forEachDialect(t, testInMemoryTryLockOneLimited)
+}
+
+func testInMemoryTryLockOneOfTwo(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
 	// now tryLock both with other ID
@@ -243,7 +390,48 @@ func TestInMemoryTryLockOneOfTwo(t *testing.T) {
 	assert.Contains(t, res, twoTargets[1].ID)
 }
 
-func TestInMemoryTryLockNoneOfTwo(t *testing.T) {
+func TestInMemoryTryLockOneOfTwo(t *testing.T) {
+	forEachDialect(t, testInMemoryTryLockOneOfTwo)
+}
+
+// TestPostgresTryLockConcurrentSkipLocked is specific to the postgres
+// dialect: it runs concurrent TryLock calls over an overlapping target pool
+// through the SELECT ... FOR UPDATE SKIP LOCKED path and asserts that they
+// all succeed and that no target is handed to more than one caller. It
+// does not measure how long the calls take.
+func TestPostgresTryLockConcurrentSkipLocked(t *testing.T) {
+	tl, ok := dialectLockers["postgres"]
+	if !ok {
+		t.Skip("no postgres dialect configured")
+	}
+	tl.ResetAllLocks(ctx)
+
+	const callers = 4
+	results := make(chan []string, callers)
+	errs := make(chan error, callers)
+	start := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		go func(caller types.JobID) {
+			<-start
+			res, err := tl.TryLock(ctx, jobID+caller, defaultJobTargetManagerAcquireTimeout, allTargets, 1)
+			results <- res
+			errs <- err
+		}(types.JobID(i))
+	}
+	close(start)
+
+	locked := map[string]bool{}
+	for i := 0; i < callers; i++ {
+		assert.NoError(t, <-errs)
+		for _, id := range <-results {
+			// a contended target may go to one caller, never to two
+			assert.False(t, locked[id], "target %s was handed out twice", id)
+			locked[id] = true
+		}
+	}
+}
+
+func testInMemoryTryLockNoneOfTwo(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
 	// now tryLock both with other ID
@@ -253,30 +441,70 @@ func TestInMemoryTryLockNoneOfTwo(t *testing.T) {
 	assert.Empty(t, res)
 }
 
-func TestRefreshLocks(t *testing.T) {
+func TestInMemoryTryLockNoneOfTwo(t *testing.T) {
+	forEachDialect(t, testInMemoryTryLockNoneOfTwo)
+}
+
+func testLockNoneOfTwoLockConflictError(t *testing.T, tl *dblocker.DBLocker) {
+	tl.ResetAllLocks(ctx)
+	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
+	// Lock (unlike TryLock) is all-or-nothing, so asking for the same
+	// contended set surfaces the conflicting owner and expiry
+	err := tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, twoTargets)
+	require.Error(t, err)
+	var conflictErr *dblocker.LockConflictError
+	require.True(t, errors.As(err, &conflictErr))
+	require.Len(t, conflictErr.Targets, 2)
+	for _, ct := range conflictErr.Targets {
+		assert.Equal(t, jobID, ct.OwnerJobID)
+		assert.WithinDuration(t, tlClock.Now().Add(defaultJobTargetManagerAcquireTimeout), ct.ExpiresAt, 0)
+	}
+}
+
+func TestLockNoneOfTwoLockConflictError(t *testing.T) {
+	forEachDialect(t, testLockNoneOfTwoLockConflictError)
+}
+
+func testRefreshLocks(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, twoTargets))
 }
 
-func TestRefreshLocksTwice(t *testing.T) {
+func TestRefreshLocks(t *testing.T) {
+	forEachDialect(t, testRefreshLocks)
+}
+
+func testRefreshLocksTwice(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, twoTargets))
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, twoTargets))
 }
 
-func TestRefreshLocksOneThenTwo(t *testing.T) {
+func TestRefreshLocksTwice(t *testing.T) {
+	forEachDialect(t, testRefreshLocksTwice)
+}
+
+func testRefreshLocksOneThenTwo(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, oneTarget))
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, twoTargets))
 }
 
-func TestRefreshLocksTwoThenOne(t *testing.T) {
+func TestRefreshLocksOneThenTwo(t *testing.T) {
+	forEachDialect(t, testRefreshLocksOneThenTwo)
+}
+
+func testRefreshLocksTwoThenOne(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, twoTargets))
 	assert.NoError(t, tl.RefreshLocks(ctx, jobID, oneTarget))
 }
 
-func TestLockExpiry(t *testing.T) {
+func TestRefreshLocksTwoThenOne(t *testing.T) {
+	forEachDialect(t, testRefreshLocksTwoThenOne)
+}
+
+func testLockExpiry(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
 	// getting them immediately fails for other owner
@@ -286,7 +514,42 @@ func TestLockExpiry(t *testing.T) {
 	assert.NoError(t, tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, twoTargets))
 }
 
-func TestRefreshMultiple(t *testing.T) {
+func TestLockExpiry(t *testing.T) {
+	forEachDialect(t, testLockExpiry)
+}
+
+func testLockExpiryEmitsEvents(t *testing.T, tl *dblocker.DBLocker) {
+	tl.ResetAllLocks(ctx)
+
+	events := tl.Subscribe(ctx)
+	drain := func() dblocker.LockEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for lock event")
+			return dblocker.LockEvent{}
+		}
+	}
+
+	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
+	ev := drain()
+	assert.Equal(t, dblocker.LockEventLocked, ev.Kind)
+	assert.Equal(t, jobID, ev.JobID)
+	assert.ElementsMatch(t, []string{twoTargets[0].ID, twoTargets[1].ID}, ev.TargetIDs)
+
+	tlClock.Add(3 * time.Second)
+	ev = drain()
+	assert.Equal(t, dblocker.LockEventExpired, ev.Kind)
+	assert.Equal(t, jobID, ev.JobID)
+	assert.ElementsMatch(t, []string{twoTargets[0].ID, twoTargets[1].ID}, ev.TargetIDs)
+}
+
+func TestLockExpiryEmitsEvents(t *testing.T) {
+	forEachDialect(t, testLockExpiryEmitsEvents)
+}
+
+func testRefreshMultiple(t *testing.T, tl *dblocker.DBLocker) {
 	// not super happy with this test, it is timing sensitive
 	tl.ResetAllLocks(ctx)
 	// now for the actual test
@@ -300,7 +563,11 @@ func TestRefreshMultiple(t *testing.T) {
 	assert.Error(t, tl.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, []*target.Target{allTargets[1]}))
 }
 
-func TestLockingTransactional(t *testing.T) {
+func TestRefreshMultiple(t *testing.T) {
+	forEachDialect(t, testRefreshMultiple)
+}
+
+func testLockingTransactional(t *testing.T, tl *dblocker.DBLocker) {
 	tl.ResetAllLocks(ctx)
 	// lock the second target
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, []*target.Target{allTargets[1]}))
@@ -310,3 +577,122 @@ func TestLockingTransactional(t *testing.T) {
 	// this means it can be locked by the first owner
 	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, []*target.Target{allTargets[0]}))
 }
+
+func TestLockingTransactional(t *testing.T) {
+	forEachDialect(t, testLockingTransactional)
+}
+
+// newNamespacedLocker builds a second DBLocker against the same database as
+// tl, scoped to namespace, so namespace isolation can be exercised without
+// disturbing the shared per-dialect fixtures.
+func newNamespacedLocker(t *testing.T, dialect, uri, namespace string) *dblocker.DBLocker {
+	l, err := dblocker.New(
+		uri,
+		dblocker.WithDialect(dblocker.Dialect(dialect)),
+		dblocker.WithClock(tlClock),
+		dblocker.WithMaxBatchSize(testBatchSize),
+		dblocker.WithNamespace(namespace),
+	)
+	require.NoError(t, err)
+	return l
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	for dialect, uri := range common.GetDatabaseURI() {
+		dialect, uri := dialect, uri
+		t.Run(dialect, func(t *testing.T) {
+			tlA := newNamespacedLocker(t, dialect, uri, "team-a")
+			tlB := newNamespacedLocker(t, dialect, uri, "team-b")
+			tlA.ResetAllLocks(ctx)
+			tlB.ResetAllLocks(ctx)
+
+			// same target ID, same underlying database, different
+			// namespaces: both must be able to lock it simultaneously
+			assert.NoError(t, tlA.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
+			assert.NoError(t, tlB.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
+		})
+	}
+}
+
+func TestNamespaceResetAllLocksDoesNotLeak(t *testing.T) {
+	for dialect, uri := range common.GetDatabaseURI() {
+		dialect, uri := dialect, uri
+		t.Run(dialect, func(t *testing.T) {
+			tlA := newNamespacedLocker(t, dialect, uri, "team-a")
+			tlB := newNamespacedLocker(t, dialect, uri, "team-b")
+			tlA.ResetAllLocks(ctx)
+			tlB.ResetAllLocks(ctx)
+
+			assert.NoError(t, tlA.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
+			assert.NoError(t, tlB.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
+
+			tlA.ResetAllLocks(ctx)
+
+			// team-a's lock is gone, so it is free for a new owner...
+			assert.NoError(t, tlA.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, oneTarget))
+			// ... but team-b's lock must be untouched
+			assert.Error(t, tlB.Lock(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, oneTarget))
+		})
+	}
+}
+
+func testLockWaitUnblocksOnUnlock(t *testing.T, tl *dblocker.DBLocker) {
+	tl.ResetAllLocks(ctx)
+	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, twoTargets))
+
+	unblocked := make(chan error, 1)
+	go func() {
+		unblocked <- tl.LockWait(ctx, jobID+1, defaultJobTargetManagerAcquireTimeout, twoTargets, 10*time.Second)
+	}()
+
+	// give the waiter a chance to register interest before releasing
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-unblocked:
+		t.Fatalf("LockWait returned before Unlock was called: %v", err)
+	default:
+	}
+
+	assert.NoError(t, tl.Unlock(ctx, jobID, twoTargets))
+
+	select {
+	case err := <-unblocked:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockWait did not unblock after Unlock")
+	}
+}
+
+func TestLockWaitUnblocksOnUnlock(t *testing.T) {
+	forEachDialect(t, testLockWaitUnblocksOnUnlock)
+}
+
+func testLockWaitContextCancellation(t *testing.T, tl *dblocker.DBLocker) {
+	tl.ResetAllLocks(ctx)
+	assert.NoError(t, tl.Lock(ctx, jobID, defaultJobTargetManagerAcquireTimeout, oneTarget))
+
+	waitCtx, cancel := xcontext.WithCancel(ctx)
+	unblocked := make(chan error, 1)
+	go func() {
+		unblocked <- tl.LockWait(waitCtx, jobID+1, defaultJobTargetManagerAcquireTimeout, oneTarget, 10*time.Second)
+	}()
+
+	// give the waiter a chance to register interest before cancelling
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-unblocked:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockWait did not return after context cancellation")
+	}
+
+	// the waiter must have been removed: releasing the target must not panic
+	// or deadlock on a notifier that still thinks someone is waiting on it
+	assert.NoError(t, tl.Unlock(ctx, jobID, oneTarget))
+}
+
+func TestLockWaitContextCancellation(t *testing.T) {
+	forEachDialect(t, testLockWaitContextCancellation)
+}